@@ -0,0 +1,63 @@
+package main
+
+import "sync"
+
+//Broker lets multiple hub instances - potentially running in different
+//processes - share the same logical hub by fanning messages published on
+//one instance out to every instance subscribed to the same hub ID. A
+//single Go process can otherwise only broadcast to the connections it
+//owns, so scaling out to more than one process requires routing messages
+//through something all processes can reach.
+type Broker interface {
+	//Publish makes message available to every Subscribe'd receiver for
+	//hubID, including ones in other processes.
+	Publish(hubID string, message []byte) error
+
+	//Subscribe returns a channel that receives every message Published
+	//for hubID, from this process or any other sharing the same broker.
+	//The channel is buffered so a subscriber that falls behind doesn't
+	//block Publish.
+	Subscribe(hubID string) (<-chan []byte, error)
+}
+
+//brokerSubBuffer is how many pending messages a Broker subscription
+//channel buffers before a subscriber that isn't reading fast enough
+//starts causing drops rather than blocking publishers.
+const brokerSubBuffer = 256
+
+//localBroker is the default Broker: it fans messages out only to
+//subscribers within this process, reproducing the hub's original
+//single-process broadcast behavior. GetHub uses this unless a different
+//Broker is supplied via WithBroker.
+type localBroker struct {
+	mu   sync.RWMutex
+	subs map[string][]chan []byte
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{subs: make(map[string][]chan []byte)}
+}
+
+func (b *localBroker) Publish(hubID string, message []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, ch := range b.subs[hubID] {
+		select {
+		case ch <- message:
+		default:
+			//A stalled subscriber shouldn't be able to block every other
+			//subscriber (or the publisher) sharing this broker.
+		}
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(hubID string) (<-chan []byte, error) {
+	ch := make(chan []byte, brokerSubBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[hubID] = append(b.subs[hubID], ch)
+	return ch, nil
+}
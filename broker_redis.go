@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//defaultRedisKeyPrefix namespaces the Redis pub/sub channels a
+//redisBroker uses, so a shared Redis instance can host channels for
+//other applications without collision.
+const defaultRedisKeyPrefix = "wschat:hub:"
+
+//redisBroker is a Broker backed by Redis PUBLISH/SUBSCRIBE, letting
+//several server processes behave as one hub: a message Published by any
+//process reaches every process that has Subscribed to the same hub ID.
+type redisBroker struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+//NewRedisBroker returns a Broker that publishes and subscribes through
+//the Redis instance at addr (a "host:port" address).
+func NewRedisBroker(addr string) *redisBroker {
+	return &redisBroker{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+		},
+		prefix: defaultRedisKeyPrefix,
+	}
+}
+
+func (b *redisBroker) channel(hubID string) string {
+	return b.prefix + hubID
+}
+
+func (b *redisBroker) Publish(hubID string, message []byte) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PUBLISH", b.channel(hubID), message)
+	return err
+}
+
+//Subscribe opens a dedicated Redis connection for hubID and relays every
+//message published on its channel to the returned channel. The
+//connection - and the returned channel - stay open until the Redis
+//connection errors out (e.g. Redis shuts down or the network drops).
+func (b *redisBroker) Subscribe(hubID string) (<-chan []byte, error) {
+	conn := b.pool.Get()
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(b.channel(hubID)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("redisBroker: subscribe to %s: %s", hubID, err)
+	}
+
+	out := make(chan []byte, brokerSubBuffer)
+	go func() {
+		defer conn.Close()
+		defer close(out)
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				select {
+				case out <- v.Data:
+				default:
+					//A slow local consumer shouldn't stall the Redis
+					//connection's read loop, so drop for this message.
+				}
+			case error:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestLocalBrokerPublishSubscribe(t *testing.T) {
+	b := newLocalBroker()
+
+	sub, err := b.Subscribe("room-1")
+	if err != nil {
+		t.Fatalf("Subscribe: %s", err)
+	}
+
+	if err := b.Publish("room-1", []byte("hello")); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+
+	select {
+	case got := <-sub:
+		if string(got) != "hello" {
+			t.Fatalf("got %q, want %q", got, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for published message")
+	}
+}
+
+func TestLocalBrokerPublishIsolatesHubs(t *testing.T) {
+	b := newLocalBroker()
+
+	sub, err := b.Subscribe("room-1")
+	if err != nil {
+		t.Fatalf("Subscribe: %s", err)
+	}
+
+	if err := b.Publish("room-2", []byte("hello")); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+
+	select {
+	case got := <-sub:
+		t.Fatalf("got unexpected message for room-1: %q", got)
+	case <-time.After(50 * time.Millisecond):
+		//Expected: room-1's subscriber never receives a message
+		//published for room-2.
+	}
+}
+
+func TestLocalBrokerDropsOnFullSubscriber(t *testing.T) {
+	b := newLocalBroker()
+
+	sub, err := b.Subscribe("room-1")
+	if err != nil {
+		t.Fatalf("Subscribe: %s", err)
+	}
+
+	//Fill the subscriber's buffer without ever draining it, then publish
+	//one more than it can hold. Publish must not block waiting on a
+	//subscriber that isn't reading.
+	for i := 0; i < brokerSubBuffer+1; i++ {
+		if err := b.Publish("room-1", []byte("m")); err != nil {
+			t.Fatalf("Publish: %s", err)
+		}
+	}
+
+	if got := len(sub); got != brokerSubBuffer {
+		t.Fatalf("subscriber buffer holds %d messages, want %d", got, brokerSubBuffer)
+	}
+}
+
+func TestRedisBrokerPublishSubscribe(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	b := NewRedisBroker(s.Addr())
+
+	sub, err := b.Subscribe("room-1")
+	if err != nil {
+		t.Fatalf("Subscribe: %s", err)
+	}
+
+	//Subscribe sends SUBSCRIBE on its own connection but doesn't wait
+	//for Redis to confirm it (the relay goroutine reads the reply), so
+	//give miniredis a moment to register it before publishing, the same
+	//way a real Redis deployment would need a moment to propagate the
+	//subscription.
+	time.Sleep(50 * time.Millisecond)
+
+	if err := b.Publish("room-1", []byte("hello")); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+
+	select {
+	case got := <-sub:
+		if string(got) != "hello" {
+			t.Fatalf("got %q, want %q", got, "hello")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for published message")
+	}
+}
+
+func TestRedisBrokerChannelNamespacing(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	b := NewRedisBroker(s.Addr())
+	if got, want := b.channel("room-1"), "wschat:hub:room-1"; got != want {
+		t.Fatalf("channel(%q) = %q, want %q", "room-1", got, want)
+	}
+}
@@ -1,79 +1,587 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"sync"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/garyburd/go-websocket/websocket"
 )
 
+//allTopic is the wildcard channel every connection is subscribed to by
+//default, preserving the old "everyone in the hub receives everything"
+//broadcast behavior for messages that don't target a specific topic.
+const allTopic = "all"
+
+//ErrAlreadySubscribed is returned by hub.Subscribe when the connection is
+//already subscribed to the given topic.
+var ErrAlreadySubscribed = errors.New("connection: already subscribed to topic")
+
+//ErrNotSubscribed is returned by hub.Unsubscribe when the connection
+//isn't currently subscribed to the given topic.
+var ErrNotSubscribed = errors.New("connection: not subscribed to topic")
+
+//ErrConnDraining is returned when a send is attempted on a connection that
+//has fallen behind and is in the process of being torn down.
+var ErrConnDraining = errors.New("connection: draining, cannot accept more sends")
+
+//ErrConnClosed is returned when any operation is attempted on a connection
+//that has already finished closing.
+var ErrConnClosed = errors.New("connection: closed")
+
+//dropPolicy controls what a connection does when its outbound ring buffer
+//(c.send) is full and a new message arrives for it.
+type dropPolicy int
+
+const (
+	//PolicyDisconnect is the original behavior: a full buffer means the
+	//client is considered stuck or gone, so the connection is drained
+	//and torn down.
+	PolicyDisconnect dropPolicy = iota
+
+	//PolicyDropOldest evicts the oldest buffered message to make room
+	//for the new one, favoring freshness over completeness.
+	PolicyDropOldest
+
+	//PolicyDropNewest discards the incoming message and keeps whatever
+	//is already buffered, favoring delivery order over freshness.
+	PolicyDropNewest
+)
+
+//rttEWMAAlpha weights how much a single round trip moves connection.rtt,
+//the exponentially-weighted moving average used for slow-client
+//detection. Lower values smooth out jitter more; higher values track
+//sudden degradation faster.
+const rttEWMAAlpha = 0.2
+
+//connState is the lifecycle state of a connection. There is no valid way
+//to observe or mutate it from outside the connection's own goroutine; all
+//of that is serialized through cmds instead.
+type connState int
+
+const (
+	stateActive connState = iota
+	stateDraining
+	stateClosed
+)
+
+//sendCmd asks the connection's owning goroutine to enqueue message for
+//delivery to the client. reply receives nil on success, or the reason the
+//send couldn't be accepted.
+type sendCmd struct {
+	message []byte
+	reply   chan error
+}
+
+//subscribeCmd asks the connection's owning goroutine to add topic to the
+//connection's subscription set.
+type subscribeCmd struct {
+	topic string
+	reply chan error
+}
+
+//unsubscribeCmd asks the connection's owning goroutine to remove topic
+//from the connection's subscription set.
+type unsubscribeCmd struct {
+	topic string
+	reply chan error
+}
+
+//closeCmd asks the connection's owning goroutine to move to
+//stateClosed and stop accepting further sends. reply receives the topics
+//the connection was subscribed to at the moment it closed, so the hub can
+//clean up its channel index without ever touching connection state
+//directly.
+type closeCmd struct {
+	reply chan []string
+}
+
+//statsCmd asks the connection's owning goroutine for its dropped-message
+//count, for hubMap's stats API.
+type statsCmd struct {
+	reply chan uint64
+}
+
+//preparePingCmd asks the connection's owning goroutine to mint a fresh
+//ping ID and record the time it was sent, so a later pongCmd can compute
+//the round trip.
+type preparePingCmd struct {
+	reply chan string
+}
+
+//pongCmd reports that a pong carrying id arrived. reply receives true if
+//the connection's RTT EWMA has now crossed rttThreshold and should be
+//evicted.
+type pongCmd struct {
+	id    string
+	reply chan bool
+}
+
+//rttCmd asks the connection's owning goroutine for the current RTT EWMA,
+//for a stats getter.
+type rttCmd struct {
+	reply chan time.Duration
+}
+
+//registerAckCmd asks the connection's owning goroutine to track id as an
+//outstanding ack, closing done once a matching ack frame arrives (see
+//completeAckCmd).
+type registerAckCmd struct {
+	id    string
+	done  chan struct{}
+	reply chan struct{}
+}
+
+//completeAckCmd reports that an ack frame for id arrived from the client,
+//and asks the connection's owning goroutine to close the corresponding
+//registerAckCmd's done channel, if any is still outstanding.
+type completeAckCmd struct {
+	id    string
+	reply chan struct{}
+}
+
 type connection struct {
 	//The websocket connection.
 	ws *websocket.Conn
 
-	//Buffered channel of outbound messages.
-	//If the buffer is reached, the client will be
-	//considered to have timed out and disconnected.
-	//This can really only happen if message order is not preserved.
+	//Buffered channel of outbound messages, read by c.writer() (and by
+	//c.loop() when it evicts the oldest message under PolicyDropOldest).
+	//Writes onto this channel are only ever performed by c.loop(), the
+	//single goroutine that owns this connection's state.
 	send chan []byte
 
-	//Have we received a kill signal?
-	dead bool
+	//cmds serializes every state transition (subscribe, unsubscribe,
+	//send, close) through the owning goroutine started in c.loop().
+	//Nothing outside c.loop() ever reads or writes c.state or c.topics
+	//directly, which is what makes this safe without a mutex: there is
+	//exactly one writer.
+	cmds chan interface{}
+
+	//closed is closed by c.loop() itself as the last thing it does,
+	//right after handling closeCmd, so loop() can exit instead of
+	//ranging over cmds forever. Every method that sends on cmds selects
+	//on closed too, so a call arriving after loop() has already exited
+	//returns instead of blocking on a channel nothing reads anymore.
+	closed chan struct{}
+
+	//state is only ever read or written from within c.loop().
+	state connState
+
+	//Topics this connection is currently subscribed to. Always contains
+	//allTopic, since every connection receives broadcast-to-everyone
+	//messages unless it explicitly unsubscribes from allTopic. Owned
+	//exclusively by c.loop().
+	topics map[string]struct{}
+
+	//policy decides what happens to an outbound message when c.send's
+	//ring buffer is already full. Owned exclusively by c.loop().
+	policy dropPolicy
+
+	//dropped counts messages discarded under PolicyDropOldest or
+	//PolicyDropNewest. Owned exclusively by c.loop(); read via statsCmd.
+	dropped uint64
+
+	//pingSeq mints the next outstanding ping ID. Owned exclusively by
+	//c.loop().
+	pingSeq uint64
+
+	//lastPingID and lastPingSent identify the most recently sent ping
+	//c.writer is still waiting on a pong for, so a late or duplicate
+	//pong can be told apart from the one that's actually outstanding.
+	//Owned exclusively by c.loop().
+	lastPingID   string
+	lastPingSent time.Time
+
+	//rtt is an exponentially-weighted moving average of observed
+	//ping/pong round trips. Owned exclusively by c.loop(); read via
+	//rttCmd.
+	rtt time.Duration
 
-	//We need to lock the connection, since it can be
-	//shared by multiple hubs (in theory), or have multiple
-	//goroutines accessing it from multiple simultaneous goroutines
-	mu sync.RWMutex
+	//rttThreshold is the RTT EWMA above which the connection is
+	//considered application-frozen (TCP-alive but not actually
+	//servicing the client) and should be evicted by the hub, even
+	//though no ordinary Send has failed. Zero disables the check.
+	rttThreshold time.Duration
+
+	//pendingAcks maps an outstanding message ID (registered via
+	//SendForAck) to the channel that's closed when a matching
+	//{"type":"ack"} frame arrives from the client. Owned exclusively by
+	//c.loop().
+	pendingAcks map[string]chan struct{}
+
+	//ID and Metadata are this connection's presence identity, set once
+	//by newConnection's options before c.loop starts and never written
+	//again, so they're safe to read from any goroutine (hub.Roster in
+	//particular) without going through cmds.
+	ID       string
+	Metadata map[string]string
 }
 
-//connection.Send is the interface that hubs and other instruments are allowed to
-//use to send a message to the user at the other end of this websocket connection
-//The hub is notified when finished by sending an empty struct over the fin channel
-func (c *connection) Send(message []byte, fin chan struct{}, h *hub) {
-	defer func() {
-		log.Printf("conn.Send: message '''%s''' to %v\n", string(message), c)
-
-		//Tell the calling function that this goroutine is done sending
-		fin <- struct{}{}
-	}()
-
-	c.mu.RLock()
-	if c.dead {
-		//Channel is already dead, we cannot send on it anymore and we must exit
-		c.mu.RUnlock()
-		return
+//ConnOption configures a connection at construction time in newConnection.
+type ConnOption func(*connection)
+
+//WithDropPolicy sets the policy applied when the connection's outbound
+//ring buffer is full. Defaults to PolicyDisconnect.
+func WithDropPolicy(policy dropPolicy) ConnOption {
+	return func(c *connection) { c.policy = policy }
+}
+
+//WithRTTThreshold sets the RTT EWMA above which c.reader will ask the hub
+//it's registered with to unregister this connection. Zero, the default,
+//disables the check.
+func WithRTTThreshold(threshold time.Duration) ConnOption {
+	return func(c *connection) { c.rttThreshold = threshold }
+}
+
+//WithIdentity sets the connection's presence identity. Typically called
+//from whatever handler hook runs at websocket upgrade time, once id and
+//any metadata (user name, auth claims, etc.) are known. If omitted,
+//newConnection mints an anonymous, process-unique ID so presence events
+//still have something to key on.
+func WithIdentity(id string, metadata map[string]string) ConnOption {
+	return func(c *connection) {
+		c.ID = id
+		c.Metadata = metadata
+	}
+}
+
+//connSeq mints anonymous connection IDs for connections constructed
+//without WithIdentity.
+var connSeq uint64
+
+//newConnection wraps ws in a connection and starts its owning goroutine.
+//The returned connection is active immediately; there is no separate
+//pre-registration lifecycle phase to gate from outside c.loop().
+func newConnection(ws *websocket.Conn, opts ...ConnOption) *connection {
+	c := &connection{
+		ws:          ws,
+		send:        make(chan []byte, sendBufferSize),
+		cmds:        make(chan interface{}),
+		closed:      make(chan struct{}),
+		topics:      make(map[string]struct{}),
+		pendingAcks: make(map[string]chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.ID == "" {
+		c.ID = fmt.Sprintf("conn-%d", atomic.AddUint64(&connSeq, 1))
+	}
+	go c.loop()
+	return c
+}
+
+//loop is the single goroutine that owns this connection's state. Every
+//other goroutine (hub workers, hub.connect, hub.disconnect, readers,
+//writers) submits an intent on c.cmds and waits for the corresponding
+//reply instead of mutating connection state themselves. This is the
+//"keep state in the code, not in shared variables" approach: ordering
+//between a send and a close is whatever order loop() happens to read
+//them off c.cmds, never a race between a close(send) in one goroutine
+//and a send <- message in another.
+//
+//loop returns as soon as it has handled a closeCmd, rather than ranging
+//over c.cmds forever: a connection's owning goroutine would otherwise
+//leak for the life of the process after every Close(). c.closed is
+//closed right before returning so callers already waiting to send
+//another command don't block on a channel loop no longer reads.
+func (c *connection) loop() {
+	for cmd := range c.cmds {
+		switch m := cmd.(type) {
+		case sendCmd:
+			m.reply <- c.handleSend(m.message)
+		case subscribeCmd:
+			m.reply <- c.handleSubscribe(m.topic)
+		case unsubscribeCmd:
+			m.reply <- c.handleUnsubscribe(m.topic)
+		case closeCmd:
+			m.reply <- c.handleClose()
+			close(c.closed)
+			return
+		case statsCmd:
+			m.reply <- c.dropped
+		case preparePingCmd:
+			m.reply <- c.handlePreparePing()
+		case pongCmd:
+			m.reply <- c.handlePong(m.id)
+		case rttCmd:
+			m.reply <- c.rtt
+		case registerAckCmd:
+			c.handleRegisterAck(m.id, m.done)
+			m.reply <- struct{}{}
+		case completeAckCmd:
+			c.handleCompleteAck(m.id)
+			m.reply <- struct{}{}
+		}
+	}
+}
+
+func (c *connection) handleSend(message []byte) error {
+	switch c.state {
+	case stateClosed:
+		return ErrConnClosed
+	case stateDraining:
+		return ErrConnDraining
 	}
-	c.mu.RUnlock()
 
-	//We don't want to try to send over the channel if another
-	//goroutine has closed this channel in the meantime. Thus, we
-	//must block writing before we send over this channel.
-	c.mu.Lock()
 	select {
-	//If the message is sent over the websocket, unlock this connection and continue
 	case c.send <- message:
-		c.mu.Unlock()
+		return nil
+	default:
+		//The ring buffer is full; what happens next depends on the
+		//connection's configured drop policy.
+	}
+
+	switch c.policy {
+	case PolicyDropOldest:
+		//Evict the oldest buffered message to make room. c.loop() is the
+		//only goroutine that ever sends on c.send, so this
+		//receive-then-send pair can't race with another writer.
+		select {
+		case <-c.send:
+			c.dropped++
+		default:
+		}
+		select {
+		case c.send <- message:
+		default:
+			//No room even after the eviction above; count the new
+			//message as dropped rather than silently losing it.
+			c.dropped++
+		}
+		return nil
+
+	case PolicyDropNewest:
+		c.dropped++
+		return nil
+
+	default:
+		//PolicyDisconnect: assume the client is stuck or gone, and stop
+		//accepting further sends. The caller (conn.Send) is responsible
+		//for asking the hub to unregister us.
+		c.state = stateDraining
+		return ErrConnDraining
+	}
+}
+
+func (c *connection) handleSubscribe(topic string) error {
+	if c.state == stateClosed {
+		return ErrConnClosed
+	}
+	if _, ok := c.topics[topic]; ok {
+		return ErrAlreadySubscribed
+	}
+	c.topics[topic] = struct{}{}
+	return nil
+}
+
+func (c *connection) handleUnsubscribe(topic string) error {
+	if _, ok := c.topics[topic]; !ok {
+		return ErrNotSubscribed
+	}
+	delete(c.topics, topic)
+	return nil
+}
 
-	//If we cannot send, this means that the user's buffer is full. At this point we basically
-	//assume that the user disconnected or is just stuck.
+//handlePreparePing mints a new ping ID and records the time it was sent,
+//so a later handlePong call can compute the round trip.
+func (c *connection) handlePreparePing() string {
+	c.pingSeq++
+	c.lastPingID = strconv.FormatUint(c.pingSeq, 10)
+	c.lastPingSent = time.Now()
+	return c.lastPingID
+}
+
+//handlePong updates the RTT EWMA if id matches the most recently sent
+//ping, and reports whether the connection should now be evicted for
+//being too slow.
+func (c *connection) handlePong(id string) bool {
+	if id == "" || id != c.lastPingID || c.lastPingSent.IsZero() {
+		//Stale, duplicate, or unsolicited pong; nothing to correlate it
+		//with.
+		return false
+	}
+
+	rtt := time.Since(c.lastPingSent)
+	c.lastPingSent = time.Time{}
+
+	if c.rtt == 0 {
+		c.rtt = rtt
+	} else {
+		c.rtt = time.Duration(rttEWMAAlpha*float64(rtt) + (1-rttEWMAAlpha)*float64(c.rtt))
+	}
+
+	return c.rttThreshold > 0 && c.rtt > c.rttThreshold
+}
+
+func (c *connection) handleRegisterAck(id string, done chan struct{}) {
+	c.pendingAcks[id] = done
+}
+
+func (c *connection) handleCompleteAck(id string) {
+	if done, ok := c.pendingAcks[id]; ok {
+		close(done)
+		delete(c.pendingAcks, id)
+	}
+}
+
+func (c *connection) handleClose() []string {
+	if c.state == stateClosed {
+		return nil
+	}
+	c.state = stateClosed
+
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+
+	close(c.send)
+	if c.ws != nil {
+		c.ws.Close()
+	}
+	return topics
+}
+
+//subscribe adds topic to the set of channels this connection receives
+//messages on. It is an error to subscribe to a topic twice; callers that
+//don't care whether the subscription is new should ignore
+//ErrAlreadySubscribed.
+//
+//subscribe is unexported on purpose: it only updates c.topics, the
+//connection's own bookkeeping. It does not touch the hub's delivery
+//index (h.channels.m), so calling it alone leaves hub.bcast unable to
+//find this connection for topic. hub.Subscribe is the public entry
+//point that keeps both in sync; call that instead.
+func (c *connection) subscribe(topic string) error {
+	reply := make(chan error, 1)
+	select {
+	case c.cmds <- subscribeCmd{topic: topic, reply: reply}:
+	case <-c.closed:
+		return ErrConnClosed
+	}
+	return <-reply
+}
+
+//unsubscribe removes topic from the set of channels this connection
+//receives messages on. See subscribe's doc comment: call hub.Unsubscribe
+//instead of this directly.
+func (c *connection) unsubscribe(topic string) error {
+	reply := make(chan error, 1)
+	select {
+	case c.cmds <- unsubscribeCmd{topic: topic, reply: reply}:
+	case <-c.closed:
+		return ErrConnClosed
+	}
+	return <-reply
+}
+
+//Close transitions the connection to stateClosed, closing the outbound
+//send channel (which causes c.writer to exit) and the underlying
+//websocket. It returns the topics the connection was subscribed to, so
+//the caller can remove it from the hub's per-topic index.
+func (c *connection) Close() []string {
+	reply := make(chan []string, 1)
+	select {
+	case c.cmds <- closeCmd{reply: reply}:
+	case <-c.closed:
+		return nil
+	}
+	return <-reply
+}
+
+//DroppedCount returns the number of messages this connection has discarded
+//under PolicyDropOldest or PolicyDropNewest, for the hub's stats API.
+func (c *connection) DroppedCount() uint64 {
+	reply := make(chan uint64, 1)
+	select {
+	case c.cmds <- statsCmd{reply: reply}:
+	case <-c.closed:
+		return 0
+	}
+	return <-reply
+}
+
+//RTT returns the connection's current exponentially-weighted moving
+//average round trip time, as measured by ping/pong keepalives. Zero
+//means no pong has been observed yet, or that the connection has
+//already closed.
+func (c *connection) RTT() time.Duration {
+	reply := make(chan time.Duration, 1)
+	select {
+	case c.cmds <- rttCmd{reply: reply}:
+	case <-c.closed:
+		return 0
+	}
+	return <-reply
+}
+
+//connection.Send is the interface that hubs and other instruments are allowed to
+//use to send a message to the user at the other end of this websocket connection.
+func (c *connection) Send(message []byte, h *hub) {
+	reply := make(chan error, 1)
+	select {
+	case c.cmds <- sendCmd{message: message, reply: reply}:
+	case <-c.closed:
+		return
+	}
+
+	switch err := <-reply; err {
+	case nil:
+		log.Printf("conn.Send: message '''%s''' to %s\n", string(message), c.ID)
+	case ErrConnClosed:
+		//Already torn down, nothing left to do.
 	default:
-		//Tell the hub to unregister us, close the send channel, and close the websocket
-		log.Printf("conn.Send: Implied disconnect of %+v\n", c)
-		//Unlock before unregistering since the act of unregistering triggers changes in c
-		c.mu.Unlock()
+		//ErrConnDraining: PolicyDisconnect and the client's buffer is
+		//full. At this point we basically assume that the user
+		//disconnected or is just stuck.
+		log.Printf("conn.Send: Implied disconnect of %s: %s\n", c.ID, err)
 		h.unregister <- c
 	}
 }
 
+//SendForAck marshals payload into a {"id":...,"type":"msg","payload":...}
+//envelope and sends it like Send, but also registers id as an
+//outstanding ack so a client-sent {"type":"ack","id":...} frame (handled
+//by c.reader) closes the returned channel. SendForAck does not itself
+//wait for that confirmation; callers that care should select on the
+//returned channel, typically with a timeout, since a lost ack otherwise
+//leaves it open forever.
+func (c *connection) SendForAck(id string, payload []byte, h *hub) (<-chan struct{}, error) {
+	message, err := json.Marshal(envelope{ID: id, Type: msgType, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	reply := make(chan struct{}, 1)
+	select {
+	case c.cmds <- registerAckCmd{id: id, done: done, reply: reply}:
+		<-reply
+	case <-c.closed:
+		return done, ErrConnClosed
+	}
+
+	c.Send(message, h)
+	return done, nil
+}
+
 //connection.reader passes messages from the user to the hub for broadcasting.
-//It also handles the 'pong' portion of ping-pong keepalives.
+//It also handles the 'pong' portion of ping-pong keepalives, completes
+//any outstanding SendForAck whose {"type":"ack"} frame has arrived, and
+//lets the client drive its own subscribe/unsubscribe via
+//{"type":"subscribe","topic":...} and {"type":"unsubscribe","topic":...}
+//envelopes.
 func (c *connection) reader(h *hub) {
 	//Shouldn't need to c.ws.Close() here because ultimately
 	// this will cause the deferred unregister in wsHandler() to fire
 	//defer c.ws.Close()
-	defer log.Printf("conn.reader: reader for %+v exited\n", c)
+	defer log.Printf("conn.reader: reader for %s exited\n", c.ID)
 	c.ws.SetReadLimit(maxMessageSize)
 	c.ws.SetReadDeadline(time.Now().Add(readWait))
 	for {
@@ -86,17 +594,99 @@ func (c *connection) reader(h *hub) {
 		switch op {
 		case websocket.OpPong:
 			c.ws.SetReadDeadline(time.Now().Add(readWait))
+
+			payload, err := ioutil.ReadAll(r)
+			if err != nil {
+				break
+			}
+			//The pong's payload is the ID of the ping it answers (see
+			//c.writer), so we can correlate it with when that ping was
+			//sent and update the RTT EWMA.
+			if evict := c.recordPong(string(payload)); evict {
+				log.Printf("conn.reader: %s exceeded RTT threshold, unregistering\n", c.ID)
+				h.unregister <- c
+			}
 		case websocket.OpText:
 			message, err := ioutil.ReadAll(r)
 			if err != nil {
 				break
 			}
+
+			if c.handleClientFrame(h, message) {
+				break
+			}
+
 			//Send the message to the hub
 			h.broadcast <- message
 		}
 	}
 }
 
+//handleClientFrame parses message as an envelope and, if its Type is one
+//reader handles directly (ack, subscribe, unsubscribe), acts on it and
+//reports true so reader doesn't also forward the frame to h.broadcast.
+//A frame that doesn't parse as an envelope, or parses but sets some
+//other Type (including the zero value), is left for reader to forward
+//as-is, preserving the legacy "raw text is broadcast to allTopic"
+//behavior for clients that don't speak the envelope format.
+func (c *connection) handleClientFrame(h *hub, message []byte) bool {
+	var e envelope
+	if err := json.Unmarshal(message, &e); err != nil {
+		return false
+	}
+
+	switch e.Type {
+	case ackType:
+		c.completeAck(e.ID)
+	case subscribeType:
+		if err := h.Subscribe(c, e.Topic); err != nil {
+			log.Printf("conn.reader: %s failed to subscribe to %s: %s\n", c.ID, e.Topic, err)
+		}
+	case unsubscribeType:
+		if err := h.Unsubscribe(c, e.Topic); err != nil {
+			log.Printf("conn.reader: %s failed to unsubscribe from %s: %s\n", c.ID, e.Topic, err)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+//recordPong reports a pong carrying id, and returns whether the
+//connection's RTT EWMA has crossed its configured rttThreshold.
+func (c *connection) recordPong(id string) bool {
+	reply := make(chan bool, 1)
+	select {
+	case c.cmds <- pongCmd{id: id, reply: reply}:
+	case <-c.closed:
+		return false
+	}
+	return <-reply
+}
+
+//completeAck reports that an ack frame for id arrived from the client.
+func (c *connection) completeAck(id string) {
+	reply := make(chan struct{}, 1)
+	select {
+	case c.cmds <- completeAckCmd{id: id, reply: reply}:
+	case <-c.closed:
+		return
+	}
+	<-reply
+}
+
+//preparePing mints a fresh ping ID and records the time it was sent, so
+//c.reader's OpPong handler can later compute the round trip.
+func (c *connection) preparePing() string {
+	reply := make(chan string, 1)
+	select {
+	case c.cmds <- preparePingCmd{reply: reply}:
+	case <-c.closed:
+		return ""
+	}
+	return <-reply
+}
+
 //connection.write actually sends a message with the given opCode and payload
 //down the wire to the user.
 func (c *connection) write(opCode int, payload []byte) error {
@@ -112,7 +702,7 @@ func (c *connection) writer() {
 	//Shouldn't need to c.ws.Close() here because ultimately
 	// this will cause the deferred unregister in wsHandler() to fire
 	//defer c.ws.Close()
-	defer log.Printf("conn.writer: writer for %+v exited\n", c)
+	defer log.Printf("conn.writer: writer for %s exited\n", c.ID)
 
 	ticker := time.NewTicker(pingPeriod)
 	defer func() { ticker.Stop() }()
@@ -129,9 +719,12 @@ func (c *connection) writer() {
 				return
 			}
 		//Client isn't getting a message in time to keep them alive, so
-		// send a ping
+		// send a ping. The ping ID round-trips in the pong's payload
+		// (see c.reader's OpPong case), letting us correlate send and
+		// receive times to measure RTT.
 		case <-ticker.C:
-			if err := c.write(websocket.OpPing, []byte{}); err != nil {
+			id := c.preparePing()
+			if err := c.write(websocket.OpPing, []byte(id)); err != nil {
 				return
 			}
 		}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+//newTestHub builds a bare hub sufficient for exercising connection
+//concurrency: just enough wiring (channels, an unregister drain loop)
+//for conn.Send's implied-disconnect path and hub.Subscribe/Unsubscribe
+//to work without pulling in GetHub's broker/worker-pool machinery.
+func newTestHub() *hub {
+	h := &hub{
+		connections: connectionMap{m: make(map[*connection]struct{})},
+		channels:    channelMap{m: make(map[string]map[*connection]struct{})},
+		unregister:  make(chan *connection, 64),
+	}
+	go func() {
+		for range h.unregister {
+		}
+	}()
+	return h
+}
+
+//TestConnSendCloseRace drives concurrent Send and Close calls against the
+//same connection under -race, the scenario the cmds/closed channel pair
+//in loop() exists to make safe: every select on c.cmds also selects on
+//c.closed, so a Send arriving after loop() has already returned from
+//handling a closeCmd can't block forever or race loop()'s own state.
+func TestConnSendCloseRace(t *testing.T) {
+	h := newTestHub()
+	c := newConnection(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Send([]byte(fmt.Sprintf("message %d", i)), h)
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.Close()
+	}()
+	wg.Wait()
+}
+
+//TestHubSubscribeUnsubscribeRace drives concurrent hub.Subscribe and
+//hub.Unsubscribe calls for the same (connection, topic) pair under
+//-race, letting the race detector check that neither the connection's
+//own bookkeeping (c.topics) nor the hub's delivery index (h.channels.m)
+//sees a racy update even though they're updated from different
+//goroutines for every call.
+func TestHubSubscribeUnsubscribeRace(t *testing.T) {
+	h := newTestHub()
+	c := newConnection(nil)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Subscribe(c, "room")
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Unsubscribe(c, "room")
+		}()
+	}
+	wg.Wait()
+}
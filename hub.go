@@ -1,11 +1,97 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 )
 
+//envelope is the small wrapper format messages are expected to arrive in
+//over h.broadcast, and that connection.SendForAck and connection.reader
+//use for request/response-style delivery confirmation. If a message
+//doesn't parse as an envelope (e.g. a legacy client sending raw text),
+//it's treated as a msgType payload destined for allTopic so the old
+//"everyone gets everything" behavior still works.
+type envelope struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Topic   string          `json:"topic,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+//Envelope Type values. msgType is the default for any envelope that
+//omits Type, preserving compatibility with the topic-only envelope
+//chunk0-1 introduced. subscribeType and unsubscribeType are how a client
+//drives its own hub.Subscribe/hub.Unsubscribe calls over the wire; see
+//connection.reader.
+const (
+	msgType         = "msg"
+	ackType         = "ack"
+	subscribeType   = "subscribe"
+	unsubscribeType = "unsubscribe"
+)
+
+//presenceTopic is the dedicated channel presence events are published on.
+//Clients that want roster/join/leave notifications subscribe to it
+//explicitly, the same way they would any other topic; clients that don't
+//care never see it mixed into their messages.
+const presenceTopic = "presence"
+
+//PresenceEventType distinguishes the kinds of message published on
+//presenceTopic.
+type PresenceEventType string
+
+const (
+	//PresenceJoin is published when a connection completes joining the hub.
+	PresenceJoin PresenceEventType = "join"
+	//PresenceLeave is published when a connection is torn down.
+	PresenceLeave PresenceEventType = "leave"
+	//PresenceRosterSnapshot is sent directly to a newly-joined connection,
+	//listing every connection present at the moment it joined.
+	PresenceRosterSnapshot PresenceEventType = "roster_snapshot"
+)
+
+//ConnectionInfo is the public identity of a connection: the bits of
+//presence state worth exposing to clients and to HTTP admin endpoints,
+//as opposed to conn.go's internal delivery/lifecycle state.
+type ConnectionInfo struct {
+	ID       string            `json:"id"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+//presenceEvent is the payload published on presenceTopic. Conn is set
+//for join/leave; Roster is set for roster_snapshot. Exactly one leave
+//event is published per connection: hub.disconnect only reaches the
+//PresenceLeave marshal/publish once per connection, since it bails out
+//before doing any teardown if the connection has already been removed
+//from h.connections.m.
+type presenceEvent struct {
+	Type   PresenceEventType `json:"type"`
+	Conn   *ConnectionInfo   `json:"conn,omitempty"`
+	Roster []ConnectionInfo  `json:"roster,omitempty"`
+}
+
+//defaultWorkerCount bounds the number of goroutines concurrently calling
+//conn.Send for a given hub. Previously hub.bcast launched one goroutine
+//per connection per message, which meant a single slow client stalled the
+//whole broadcast loop (bcast blocked on finChan) and unbounded goroutine
+//spawning under load was a DoS vector. A fixed-size pool amortizes that.
+const defaultWorkerCount = 8
+
+//jobQueueSize is how many pending (conn, message) sends hub.bcast will
+//buffer for the worker pool before it starts dropping jobs and logging
+//the overflow, rather than blocking h.deliver's loop.
+const jobQueueSize = 1024
+
+//sendJob is one (connection, message) pair waiting to be delivered by a
+//worker goroutine.
+type sendJob struct {
+	conn    *connection
+	message []byte
+}
+
 type hubMap struct {
 	m  map[string](*hub)
 	mu sync.RWMutex
@@ -22,14 +108,35 @@ func (all *hubMap) BroadcastAll(input []byte) {
 	return
 }
 
-func GetHub(id string) *hub {
+//HubOption configures a hub at construction time, the way a new
+//cross-cutting knob (here, which Broker to use) gets added without
+//breaking GetHub's existing callers.
+type HubOption func(*hub)
+
+//WithBroker makes GetHub use broker to fan messages out to other
+//processes sharing the same hub ID, instead of the in-process default.
+func WithBroker(broker Broker) HubOption {
+	return func(h *hub) { h.broker = broker }
+}
+
+//GetHub returns the hub for id, creating it (and subscribing it to its
+//broker) if this is the first call for that id. It fails if the broker
+//subscription fails: a hub that never completes that subscription would
+//never receive anything published for its ID - including from its own
+//h.run, since h.run only ever publishes through the broker and relies
+//on h.deliver's broker subscription to feed it back for local delivery
+//- so returning a hub in that state would silently drop every message.
+//Callers get a real error instead, and the id is left free for a later
+//GetHub call to retry against, rather than caching the broken hub
+//forever.
+func GetHub(id string, opts ...HubOption) (*hub, error) {
 	hubs.mu.RLock()
 
 	//Hub has already been created
 	if hubs.m[id] != nil {
 		defer hubs.mu.RUnlock()
 		log.Printf("GetHub: hub %s already exists\n", id)
-		return hubs.m[id]
+		return hubs.m[id], nil
 	}
 	hubs.mu.RUnlock()
 
@@ -37,18 +144,47 @@ func GetHub(id string) *hub {
 	hubs.mu.Lock()
 	defer hubs.mu.Unlock()
 
+	//Another caller may have created and registered the hub between our
+	//RUnlock above and this Lock.
+	if hubs.m[id] != nil {
+		log.Printf("GetHub: hub %s already exists\n", id)
+		return hubs.m[id], nil
+	}
+
 	h := &hub{
 		id:          id,
 		broadcast:   make(chan []byte, 256), //Guarantee up to 256 messages in order
 		register:    make(chan *connection),
 		unregister:  make(chan *connection),
 		connections: connectionMap{m: make(map[*connection]struct{})},
+		channels:    channelMap{m: make(map[string]map[*connection]struct{})},
+		jobs:        make(chan sendJob, jobQueueSize),
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.broker == nil {
+		h.broker = newLocalBroker()
+	}
+
+	//Subscribe to the broker before anything is Published, so the first
+	//message published for this hub can never be missed waiting for the
+	//subscription to be set up.
+	sub, err := h.broker.Subscribe(id)
+	if err != nil {
+		return nil, fmt.Errorf("GetHub: broker subscribe failed for hub %s: %s", id, err)
+	}
+	h.brokerSub = sub
+	go h.deliver()
+
 	log.Printf("hubs.m is %+v", hubs.m)
 	hubs.m[id] = h
+	for i := 0; i < defaultWorkerCount; i++ {
+		go h.worker()
+	}
 	go h.run()
 	log.Printf("GetHub: new hub %s created\n", id)
-	return h
+	return h, nil
 }
 
 type connectionMap struct {
@@ -57,12 +193,23 @@ type connectionMap struct {
 	//exists bool
 }
 
+//channelMap indexes the connections subscribed to each topic, so bcast
+//doesn't have to walk every connection in the hub (and check its
+//subscriptions) on every message.
+type channelMap struct {
+	m  map[string]map[*connection]struct{}
+	mu sync.RWMutex
+}
+
 type hub struct {
 	id string
 
 	// Registered connections.
 	connections connectionMap
 
+	// Per-topic index of subscribed connections.
+	channels channelMap
+
 	// Inbound messages from the connections.
 	//The buffer, if any, guarantees the number of
 	//messages which will be received by every client in order
@@ -73,6 +220,26 @@ type hub struct {
 
 	// Unregister requests from connections.
 	unregister chan *connection
+
+	// Pending (connection, message) sends, drained by a bounded pool of
+	// worker goroutines started in GetHub.
+	jobs chan sendJob
+
+	// broker fans messages published on h.broadcast out to every
+	// process sharing this hub ID. Defaults to an in-process-only
+	// localBroker; see WithBroker.
+	broker Broker
+
+	// brokerSub receives every message the broker has delivered for
+	// this hub ID, including this process's own publishes. h.deliver
+	// reads from it to perform local delivery via h.bcast.
+	brokerSub <-chan []byte
+
+	// queueDrops counts jobs hub.bcast couldn't hand to the worker pool
+	// because h.jobs was full, for hub.Stats/hubMap.Stats. Accessed with
+	// sync/atomic since hub.bcast (on h.deliver's goroutine) and
+	// hub.Stats (on any caller's goroutine) touch it concurrently.
+	queueDrops uint64
 }
 
 func (h *hub) run() {
@@ -85,104 +252,325 @@ func (h *hub) run() {
 			//Delete a connection
 			go h.disconnect(connection)
 		case message := <-h.broadcast:
-			//We've received a message that is potentially supposed to be broadcast
-
-			//If not a goroutine messages will be received by each client in order
-			//(unless 1: there is a goroutine internally, or 2: hub.broadcast is unbuffered or is over its buffer)
-			//If a goroutine, no guarantee about message order
-			h.bcast(message)
+			//We've received a message that is potentially supposed to be
+			//broadcast. Rather than deliver it to local connections
+			//directly, publish it through the broker; h.deliver is the
+			//only place that ever calls h.bcast, whether the message
+			//originated here or in another process sharing this hub ID.
+			if err := h.broker.Publish(h.id, message); err != nil {
+				log.Printf("hub.run: broker publish failed for hub %s: %s\n", h.id, err)
+			}
 		}
 	}
 }
 
-func (h *hub) connect(connection *connection) {
+//deliver performs local delivery for every message the broker has routed
+//to this hub ID, whether it was published by this process or another one
+//sharing the broker. This is the only path that calls h.bcast, so a
+//multi-process deployment and a single-process one behave identically
+//from bcast's point of view.
+func (h *hub) deliver() {
+	for message := range h.brokerSub {
+		topic, payload := parseEnvelope(message)
+		h.bcast(topic, payload)
+	}
+}
+
+//parseEnvelope pulls the topic and payload out of a {"topic":...,"payload":...}
+//envelope. Messages that don't parse as an envelope (e.g. a legacy raw-text
+//client) are treated as a payload for allTopic, preserving the old
+//broadcast-to-everyone behavior.
+func parseEnvelope(message []byte) (string, []byte) {
+	var e envelope
+	if err := json.Unmarshal(message, &e); err != nil || e.Topic == "" {
+		return allTopic, message
+	}
+	return e.Topic, []byte(e.Payload)
+}
+
+//Subscribe adds conn to the set of connections subscribed to topic,
+//updating both conn's own bookkeeping and the hub's delivery index
+//(h.channels.m) that hub.bcast actually reads. This is the only public
+//entry point for subscribing a connection to a topic, whether the
+//subscription originates inside the hub (e.g. hub.connect subscribing
+//every new connection to allTopic) or from a client-sent
+//{"type":"subscribe"} envelope (see connection.reader). Duplicate
+//subscriptions are rejected with connection.ErrAlreadySubscribed.
+func (h *hub) Subscribe(conn *connection, topic string) error {
+	//Hold h.channels.mu across both updates so a concurrent Unsubscribe
+	//for the same pair can't interleave and leave them out of step.
+	h.channels.mu.Lock()
+	defer h.channels.mu.Unlock()
+	if err := conn.subscribe(topic); err != nil {
+		return err
+	}
+
+	if h.channels.m[topic] == nil {
+		h.channels.m[topic] = make(map[*connection]struct{})
+	}
+	h.channels.m[topic][conn] = struct{}{}
+	return nil
+}
+
+//Unsubscribe removes conn from the set of connections subscribed to
+//topic, updating both conn's own bookkeeping and the hub's delivery
+//index, and drops the now-empty topic index entry, if any. See
+//Subscribe's doc comment: this is the public counterpart driven either
+//internally or by a client-sent {"type":"unsubscribe"} envelope.
+func (h *hub) Unsubscribe(conn *connection, topic string) error {
+	h.channels.mu.Lock()
+	defer h.channels.mu.Unlock()
+	if err := conn.unsubscribe(topic); err != nil {
+		return err
+	}
+
+	delete(h.channels.m[topic], conn)
+	if len(h.channels.m[topic]) == 0 {
+		delete(h.channels.m, topic)
+	}
+	return nil
+}
+
+func (h *hub) connect(conn *connection) {
 	h.connections.mu.Lock()
-	h.connections.m[connection] = struct{}{}
+	h.connections.m[conn] = struct{}{}
 	numCons := len(h.connections.m)
 	h.connections.mu.Unlock()
 
-	//Unless register and unregister have a buffer, make sure any messaging during these
-	//processes is concurrent.
-	go func() {
-		h.broadcast <- []byte(fmt.Sprintf("hub.connect: %v connected", connection))
-		h.broadcast <- []byte(fmt.Sprintf("%d clients currently connected to hub %s\n", numCons, h.id))
-	}()
-	log.Printf("hub.connect: %v connected\n", connection)
+	//Every connection is subscribed to allTopic by default, so the
+	//pre-pub/sub "everyone gets everything" behavior still works out of
+	//the box.
+	if err := h.Subscribe(conn, allTopic); err != nil {
+		log.Printf("hub.connect: %s failed to subscribe to %s: %s\n", conn.ID, allTopic, err)
+	}
+
+	h.joinPresence(conn)
+
+	log.Printf("hub.connect: %s connected\n", conn.ID)
 	log.Printf("hub.connect: %d clients currently connected\n", numCons)
 }
 
-func (h *hub) disconnect(connection *connection) {
+//joinPresence subscribes connection to presenceTopic and hands it a
+//roster_snapshot directly, both while holding h.channels' write lock, so
+//no join/leave event for any other connection can be delivered to it
+//first - the ordering race EXTERNAL DOC 3 describes. A concurrent
+//hub.bcast(presenceTopic, ...) needs channels.mu's read lock to find
+//connection in the topic index at all, so it can't queue a send to
+//connection for the worker pool until this function releases the lock,
+//which it only does after the snapshot has already been handed to
+//connection's own send buffer.
+func (h *hub) joinPresence(conn *connection) {
+	h.channels.mu.Lock()
+	//conn.subscribe directly, rather than h.Subscribe: h.Subscribe would
+	//try to re-acquire h.channels.mu, which is already held here so the
+	//roster snapshot below can be sent before any other join/leave event
+	//reaches this connection.
+	if err := conn.subscribe(presenceTopic); err != nil {
+		h.channels.mu.Unlock()
+		log.Printf("hub.connect: %s failed to subscribe to %s: %s\n", conn.ID, presenceTopic, err)
+		return
+	}
+	if h.channels.m[presenceTopic] == nil {
+		h.channels.m[presenceTopic] = make(map[*connection]struct{})
+	}
+	h.channels.m[presenceTopic][conn] = struct{}{}
+
+	snapshot, err := json.Marshal(presenceEvent{Type: PresenceRosterSnapshot, Roster: h.Roster()})
+	if err != nil {
+		h.channels.mu.Unlock()
+		log.Printf("hub.connect: failed to marshal roster snapshot for %s: %s\n", conn.ID, err)
+		return
+	}
+	conn.Send(snapshot, h)
+	h.channels.mu.Unlock()
+
+	join, err := json.Marshal(presenceEvent{Type: PresenceJoin, Conn: &ConnectionInfo{ID: conn.ID, Metadata: conn.Metadata}})
+	if err != nil {
+		log.Printf("hub.connect: failed to marshal join event for %s: %s\n", conn.ID, err)
+		return
+	}
+	h.publishPresence(join)
+}
+
+//disconnect tears conn down and removes it from the hub. conn.Send and
+//conn.reader both push onto h.unregister as soon as they notice a
+//connection is stuck or gone, and a single connection can trigger that
+//more than once (e.g. several jobs already enqueued for it in h.jobs all
+//hit ErrConnDraining in turn once it starts draining), so disconnect has
+//to be idempotent: it bails out immediately if conn was already removed,
+//rather than redoing teardown - and republishing a leave event - for a
+//connection that's already gone.
+func (h *hub) disconnect(conn *connection) {
 	//could wrap these in goroutines with semaphores to make sure
 	//that hub.disconnect() doesn't return until both goroutines are
 	//done
 	h.connections.mu.Lock()
-	delete(h.connections.m, connection)
+	if _, ok := h.connections.m[conn]; !ok {
+		h.connections.mu.Unlock()
+		return
+	}
+	delete(h.connections.m, conn)
 	numCons := len(h.connections.m)
 	h.connections.mu.Unlock()
 
-	connection.mu.Lock()
-	connection.dead = true
-	close(connection.send)
-	connection.ws.Close()
-	connection.mu.Unlock()
-
-	//Unless register and unregister have a buffer, make sure any messaging during these
-	//processes is concurrent.
-	if numCons > 0 {
-		go func() {
-			h.broadcast <- []byte(fmt.Sprintf("hub.disconnect: %v disconnected", connection))
-			h.broadcast <- []byte(fmt.Sprintf("%d clients currently connected to hub %s\n", numCons, h.id))
-			log.Printf("\nhub.disconnect: FINAL NOTICE %v disconnected FINAL NOTICE\n", connection)
-			log.Printf("hub.connect: %d clients currently connected\n", numCons)
-		}()
+	//connection.Close serializes the state transition to stateClosed
+	//through the connection's own owning goroutine (see conn.go), closing
+	//its send channel and websocket for us, and handing back the topics
+	//it was subscribed to so we can clean up the channel index below.
+	topics := conn.Close()
+
+	h.channels.mu.Lock()
+	for _, topic := range topics {
+		delete(h.channels.m[topic], conn)
+		if len(h.channels.m[topic]) == 0 {
+			delete(h.channels.m, topic)
+		}
+	}
+	h.channels.mu.Unlock()
+
+	leave, err := json.Marshal(presenceEvent{Type: PresenceLeave, Conn: &ConnectionInfo{ID: conn.ID, Metadata: conn.Metadata}})
+	if err != nil {
+		log.Printf("hub.disconnect: failed to marshal leave event for %s: %s\n", conn.ID, err)
 	} else {
+		h.publishPresence(leave)
+	}
+	log.Printf("\nhub.disconnect: FINAL NOTICE %s disconnected FINAL NOTICE\n", conn.ID)
+	log.Printf("hub.connect: %d clients currently connected\n", numCons)
+
+	if numCons == 0 {
 		defer func() {
 			hubs.mu.Lock()
 			defer func() { hubs.mu.Unlock() }()
 			delete(hubs.m, h.id)
-			
-			log.Printf("hub.disconnect: these hubs now exist: %+v\n", hubs.m) 
+
+			log.Printf("hub.disconnect: these hubs now exist: %+v\n", hubs.m)
 		}()
 	}
 }
 
-func (h *hub) bcast(message []byte) {
-	//RLock here would guarantee that the map won't change while we iterate over it BUT other goroutines
-	// could read the next message simultaneously, so message order is not guaranteed. However, concurrency
-	// is maximized.
-	//Lock here would guarantee that the map won't change while we iterate over it AND that
-	// this is the only goroutine currently reading the map (i.e., it would preserve message order). The
-	// degree to which concurrency is impaired depends on whether conn.Send() is called as a goroutine or not.
-	//If conn.Send() is called as a goroutine, then choosing between Lock or RLock is of minimal importance,
-	// as they would both protect the map just until each connection was launched (but not finished).
-	//If conn.Send() is called as a normal routine, then
+//bcast fans a message out to every connection subscribed to topic by
+//handing each (connection, message) pair to the worker pool started in
+//GetHub, instead of launching one goroutine per connection per message.
+//It never blocks waiting for delivery to finish: a slow or stuck
+//subscriber is the worker pool's and that connection's problem (see
+//conn.go's dropPolicy), not something that stalls every other message
+//h.deliver needs to process.
+func (h *hub) bcast(topic string, message []byte) {
+	h.channels.mu.RLock()
+	defer h.channels.mu.RUnlock()
+
+	for conn := range h.channels.m[topic] {
+		select {
+		case h.jobs <- sendJob{conn: conn, message: message}:
+		default:
+			//The worker pool is saturated; drop this job rather than
+			//block h.deliver's loop for every other connection and
+			//topic waiting behind it.
+			atomic.AddUint64(&h.queueDrops, 1)
+			log.Printf("hub.bcast: job queue full, dropping message for topic %s to conn %s\n", topic, conn.ID)
+		}
+	}
+}
+
+//worker is one of a fixed-size pool of goroutines that deliver queued
+//sends. Bounding the pool (rather than spawning a goroutine per send)
+//caps how much concurrent work a burst of messages can create.
+func (h *hub) worker() {
+	for job := range h.jobs {
+		job.conn.Send(job.message, h)
+	}
+}
+
+//ConnStats is a point-in-time snapshot of one connection's delivery
+//health, returned by hub.Stats and hubMap.Stats. It carries Conn's
+//public identity rather than the connection itself, the same
+//encapsulation the presence subsystem's ConnectionInfo establishes: a
+//caller reading stats has no business reaching back into a live,
+//mutable *connection.
+type ConnStats struct {
+	Conn    ConnectionInfo
+	Dropped uint64
+}
+
+//HubStats is a point-in-time snapshot of a hub's delivery health,
+//returned by hub.Stats and hubMap.Stats.
+type HubStats struct {
+	//Conns holds one ConnStats per connection currently registered with
+	//the hub.
+	Conns []ConnStats
+
+	//QueueDrops counts messages hub.bcast has discarded because the
+	//worker pool's job queue (h.jobs) was full. Unlike each ConnStats'
+	//Dropped, which is scoped to a single slow or stuck connection, this
+	//counts drops caused by the pool itself being saturated across every
+	//connection and topic.
+	QueueDrops uint64
+}
+
+//Stats returns a snapshot of the hub's delivery health: per-connection
+//dropped-message counters plus the queue-level drop count.
+func (h *hub) Stats() HubStats {
 	h.connections.mu.RLock()
+	defer h.connections.mu.RUnlock()
 
-	//Count launched routines
-	i := 0
-	finChan := make(chan struct{})
+	conns := make([]ConnStats, 0, len(h.connections.m))
 	for conn := range h.connections.m {
-		//For every connected user, do something with the message or disconnect
-		//Each user may have a different delay, but no user blocks others
+		conns = append(conns, ConnStats{
+			Conn:    ConnectionInfo{ID: conn.ID, Metadata: conn.Metadata},
+			Dropped: conn.DroppedCount(),
+		})
+	}
+	return HubStats{Conns: conns, QueueDrops: atomic.LoadUint64(&h.queueDrops)}
+}
 
-		//To simulate different users getting different messages, we'll send timestamps and sleep, too:
-		log.Printf("hub.bcast: conn.Send'ing message '''%v''' to conn %v\n", string(message), conn)
+//Stats returns a delivery-health snapshot for every hub, keyed by hub ID.
+func (all *hubMap) Stats() map[string]HubStats {
+	all.mu.RLock()
+	defer all.mu.RUnlock()
 
-		//Do not wait for one client's send before launching the next
-		go conn.Send(message, finChan, h)
-		i++
+	stats := make(map[string]HubStats, len(all.m))
+	for id, h := range all.m {
+		stats[id] = h.Stats()
 	}
+	return stats
+}
 
-	//Done iterating over the map
-	h.connections.mu.RUnlock()
+//Roster returns the identity of every connection currently registered
+//with the hub.
+func (h *hub) Roster() []ConnectionInfo {
+	h.connections.mu.RLock()
+	defer h.connections.mu.RUnlock()
 
-	//Drain all finChan values; afterwards, we'll unblock
-	for i > 0 {
-		select {
-		case <-finChan:
-			i--
-		}
+	roster := make([]ConnectionInfo, 0, len(h.connections.m))
+	for conn := range h.connections.m {
+		roster = append(roster, ConnectionInfo{ID: conn.ID, Metadata: conn.Metadata})
 	}
+	return roster
+}
+
+//publishPresence wraps payload in a topic envelope for presenceTopic and
+//sends it through h.broadcast, same as any other published message, so
+//it's delivered to local subscribers via h.deliver and fanned out to
+//other processes via h.broker like everything else.
+func (h *hub) publishPresence(payload []byte) {
+	message, err := json.Marshal(envelope{Topic: presenceTopic, Payload: payload})
+	if err != nil {
+		log.Printf("hub.publishPresence: failed to marshal envelope: %s\n", err)
+		return
+	}
+	h.broadcast <- message
+}
+
+//Roster returns the identity of every connection registered with the hub
+//named id, for an HTTP admin endpoint to expose. ok is false if no such
+//hub exists.
+func (all *hubMap) Roster(id string) (roster []ConnectionInfo, ok bool) {
+	all.mu.RLock()
+	defer all.mu.RUnlock()
 
-	log.Printf("hub.bcast: bcast'ing message ```%v``` is done.", string(message))
+	h, ok := all.m[id]
+	if !ok {
+		return nil, false
+	}
+	return h.Roster(), true
 }
@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+//failingBroker's Subscribe always errors, simulating a broker that's
+//unreachable (e.g. Redis down) at hub-creation time.
+type failingBroker struct{}
+
+func (failingBroker) Publish(hubID string, message []byte) error { return nil }
+func (failingBroker) Subscribe(hubID string) (<-chan []byte, error) {
+	return nil, errBrokerUnavailable
+}
+
+var errBrokerUnavailable = errDummy("broker unavailable")
+
+type errDummy string
+
+func (e errDummy) Error() string { return string(e) }
+
+func TestGetHubFailsLoudlyOnBrokerSubscribeError(t *testing.T) {
+	id := "test-hub-broker-failure"
+
+	h, err := GetHub(id, WithBroker(failingBroker{}))
+	if err == nil {
+		t.Fatal("expected an error when the broker subscribe fails, got nil")
+	}
+	if h != nil {
+		t.Fatal("expected a nil hub alongside the error")
+	}
+
+	hubs.mu.RLock()
+	_, cached := hubs.m[id]
+	hubs.mu.RUnlock()
+	if cached {
+		t.Fatal("GetHub must not cache a hub whose broker subscribe failed")
+	}
+}
+
+//TestStatsExposesConnectionInfoNotConnection checks that hub.Stats
+//mirrors the encapsulation ConnectionInfo already establishes for
+//presence events: callers get the connection's public identity, not a
+//live *connection they could reach back into.
+func TestStatsExposesConnectionInfoNotConnection(t *testing.T) {
+	h := &hub{
+		connections: connectionMap{m: make(map[*connection]struct{})},
+		channels:    channelMap{m: make(map[string]map[*connection]struct{})},
+		jobs:        make(chan sendJob, 1),
+	}
+
+	c := newConnection(nil, WithIdentity("conn-x", map[string]string{"role": "tester"}))
+	defer c.Close()
+	h.connections.m[c] = struct{}{}
+
+	stats := h.Stats()
+	if len(stats.Conns) != 1 {
+		t.Fatalf("len(stats.Conns) = %d, want 1", len(stats.Conns))
+	}
+	got := stats.Conns[0].Conn
+	want := ConnectionInfo{ID: "conn-x", Metadata: map[string]string{"role": "tester"}}
+	if got.ID != want.ID || got.Metadata["role"] != want.Metadata["role"] {
+		t.Fatalf("stats.Conns[0].Conn = %+v, want %+v", got, want)
+	}
+}
+
+//TestStatsCountsQueueDrops checks that hub.bcast dropping a job because
+//h.jobs is full shows up in HubStats.QueueDrops, separate from any
+//individual connection's own DroppedCount.
+func TestStatsCountsQueueDrops(t *testing.T) {
+	h := &hub{
+		connections: connectionMap{m: make(map[*connection]struct{})},
+		channels:    channelMap{m: make(map[string]map[*connection]struct{})},
+		jobs:        make(chan sendJob), //unbuffered: every bcast send is dropped
+	}
+
+	c := newConnection(nil)
+	defer c.Close()
+	h.connections.m[c] = struct{}{}
+	h.channels.m["room"] = map[*connection]struct{}{c: {}}
+
+	h.bcast("room", []byte("one"))
+	h.bcast("room", []byte("two"))
+
+	if got, want := h.Stats().QueueDrops, uint64(2); got != want {
+		t.Fatalf("QueueDrops = %d, want %d", got, want)
+	}
+}